@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	body := []byte(`{"Path":"/foo","Event":"Create"}`)
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequest("POST", "http://itdoesntmatter.lol", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(timestampHeader, ts)
+	req.Header.Set(signatureHeader, "sha256="+sign("s3kret", ts, body))
+
+	if err := Verify(req, "s3kret"); err != nil {
+		t.Errorf("Verify failed for a correctly signed request: %s", err)
+	}
+	if err := Verify(req, "wrong"); err == nil {
+		t.Errorf("Verify should have failed with the wrong secret")
+	}
+}
+
+func TestVerifyRejectsStaleTimestamp(t *testing.T) {
+	body := []byte(`{"Path":"/foo","Event":"Create"}`)
+	ts := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	req, err := http.NewRequest("POST", "http://itdoesntmatter.lol", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(timestampHeader, ts)
+	req.Header.Set(signatureHeader, "sha256="+sign("s3kret", ts, body))
+
+	if err := Verify(req, "s3kret"); err == nil {
+		t.Errorf("Verify should reject a correctly signed request whose timestamp is too old, to block replay")
+	}
+}
+
+func TestVerifyMissingHeaders(t *testing.T) {
+	req, err := http.NewRequest("POST", "http://itdoesntmatter.lol", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(req, "s3kret"); err == nil {
+		t.Errorf("Verify should fail when no signature header is present")
+	}
+}
+
+func TestRequireBearerToken(t *testing.T) {
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	})
+	wrapped := RequireBearerToken(inner, "s3kret")
+
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "http://itdoesntmatter.lol", nil)
+	wrapped.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 with no Authorization header, got %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	request.Header.Set("Authorization", "Bearer s3kret")
+	wrapped.ServeHTTP(recorder, request)
+	if recorder.Code != 200 {
+		t.Errorf("expected 200 with a valid token, got %d", recorder.Code)
+	}
+}
+
+func TestRequireBearerTokenDisabled(t *testing.T) {
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	})
+	wrapped := RequireBearerToken(inner, "")
+
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "http://itdoesntmatter.lol", nil)
+	wrapped.ServeHTTP(recorder, request)
+	if recorder.Code != 200 {
+		t.Errorf("expected auth to be a no-op when no token is configured, got %d", recorder.Code)
+	}
+}
+
+func TestRequireAuthAcceptsBearerToken(t *testing.T) {
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	})
+	wrapped := RequireAuth(inner, "s3kret", "sh4red")
+
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "http://itdoesntmatter.lol", nil)
+	request.Header.Set("Authorization", "Bearer s3kret")
+	wrapped.ServeHTTP(recorder, request)
+	if recorder.Code != 200 {
+		t.Errorf("expected 200 with a valid bearer token, got %d", recorder.Code)
+	}
+}
+
+func TestRequireAuthAcceptsSignedRequest(t *testing.T) {
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	})
+	wrapped := RequireAuth(inner, "s3kret", "sh4red")
+
+	body := []byte(`{"Path":"/foo","Event":"Create"}`)
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	request, _ := http.NewRequest("POST", "http://itdoesntmatter.lol", bytes.NewBuffer(body))
+	request.Header.Set(timestampHeader, ts)
+	request.Header.Set(signatureHeader, "sha256="+sign("sh4red", ts, body))
+
+	recorder := httptest.NewRecorder()
+	wrapped.ServeHTTP(recorder, request)
+	if recorder.Code != 200 {
+		t.Errorf("expected 200 with a validly signed request, got %d", recorder.Code)
+	}
+}
+
+func TestRequireAuthRejectsUnauthenticated(t *testing.T) {
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	})
+	wrapped := RequireAuth(inner, "s3kret", "sh4red")
+
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "http://itdoesntmatter.lol", nil)
+	wrapped.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 with neither a bearer token nor a signature, got %d", recorder.Code)
+	}
+}
+
+func TestRequireAuthDisabled(t *testing.T) {
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	})
+	wrapped := RequireAuth(inner, "", "")
+
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "http://itdoesntmatter.lol", nil)
+	wrapped.ServeHTTP(recorder, request)
+	if recorder.Code != 200 {
+		t.Errorf("expected auth to be a no-op when neither token nor secret is configured, got %d", recorder.Code)
+	}
+}
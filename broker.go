@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// subscriberBufferSize is how many events a single Subscriber can have
+// queued before the Broker starts dropping events for it rather than
+// blocking the publisher.
+const subscriberBufferSize = 32
+
+// heartbeatInterval is how often subscribers are sent a ping, which keeps
+// intermediate proxies and load balancers from closing an otherwise idle
+// connection.
+const heartbeatInterval = 30 * time.Second
+
+// Subscriber represents a single live client listening for SendableEvents
+// whose Path matches pattern.
+type Subscriber struct {
+	pattern string
+	events  chan SendableEvent
+	done    chan struct{}
+}
+
+// newSubscriber returns a *Subscriber listening for events matching pattern.
+func newSubscriber(pattern string) *Subscriber {
+	return &Subscriber{
+		pattern: pattern,
+		events:  make(chan SendableEvent, subscriberBufferSize),
+		done:    make(chan struct{}),
+	}
+}
+
+// Broker fans SendableEvents out to the registered HTTP callbacks (via an
+// embedded CallbackStorer) and to any live Subscribers connected over SSE
+// or WebSocket. It sits between Monitor's output channel and the rest of
+// the server so both delivery mechanisms see the same events.
+type Broker struct {
+	CallbackStorer
+	lock        *sync.RWMutex
+	subscribers map[*Subscriber]bool
+}
+
+// NewBroker returns a *Broker that triggers callbacks through cbs and fans
+// events out to Subscribers registered with Subscribe.
+func NewBroker(cbs CallbackStorer) *Broker {
+	return &Broker{
+		CallbackStorer: cbs,
+		lock:           &sync.RWMutex{},
+		subscribers:    make(map[*Subscriber]bool),
+	}
+}
+
+// Subscribe registers a new Subscriber for pattern and returns it. Callers
+// must pass the returned Subscriber to Unsubscribe when they're done with
+// it or its events channel will leak.
+func (b *Broker) Subscribe(pattern string) *Subscriber {
+	sub := newSubscriber(pattern)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.subscribers[sub] = true
+	return sub
+}
+
+// Unsubscribe removes sub from the Broker and closes its done channel so
+// any handler blocked reading from it can return.
+func (b *Broker) Unsubscribe(sub *Subscriber) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if _, ok := b.subscribers[sub]; ok {
+		delete(b.subscribers, sub)
+		close(sub.done)
+	}
+}
+
+// Publish triggers any matching HTTP callbacks and pushes se to every
+// Subscriber whose pattern matches se.Path. A Subscriber that hasn't
+// drained its buffer gets the event dropped for it rather than blocking
+// the rest of the fan-out.
+func (b *Broker) Publish(se SendableEvent) {
+	if err := b.Trigger(se.Path, &se); err != nil {
+		log.Printf("triggering callbacks for %s: %s", se.Path, err)
+	}
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	for sub := range b.subscribers {
+		if !matchGlob(sub.pattern, se.Path) {
+			continue
+		}
+		select {
+		case sub.events <- se:
+		default:
+			log.Printf("subscriber for %s is too slow, dropping event %v", sub.pattern, se)
+		}
+	}
+}
+
+// EventsHandler exposes a Broker's live event stream over HTTP. It upgrades
+// to a WebSocket connection when the request asks for one and falls back
+// to Server-Sent Events otherwise.
+type EventsHandler struct {
+	broker   *Broker
+	upgrader websocket.Upgrader
+}
+
+// NewEventsHandler returns an *EventsHandler backed by broker.
+func NewEventsHandler(broker *Broker) *EventsHandler {
+	return &EventsHandler{
+		broker:   broker,
+		upgrader: websocket.Upgrader{},
+	}
+}
+
+// ServeHTTP subscribes the requester to the path (or ?pattern= query
+// parameter, for globs) and streams matching events until the client
+// disconnects.
+func (e *EventsHandler) ServeHTTP(resp http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		http.Error(resp, "Not Found!", 404)
+		return
+	}
+	pattern := request.URL.Path
+	if q := request.URL.Query().Get("pattern"); q != "" {
+		pattern = q
+	}
+	if pattern == "" {
+		pattern = "**"
+	}
+	sub := e.broker.Subscribe(pattern)
+	defer e.broker.Unsubscribe(sub)
+
+	if websocket.IsWebSocketUpgrade(request) {
+		e.serveWebSocket(resp, request, sub)
+		return
+	}
+	e.serveSSE(resp, request, sub)
+}
+
+func (e *EventsHandler) serveSSE(resp http.ResponseWriter, request *http.Request, sub *Subscriber) {
+	flusher, ok := resp.(http.Flusher)
+	if !ok {
+		http.Error(resp, "Streaming unsupported.", 500)
+		return
+	}
+	resp.Header().Set("Content-Type", "text/event-stream")
+	resp.Header().Set("Cache-Control", "no-cache")
+	resp.Header().Set("Connection", "keep-alive")
+	flusher.Flush()
+
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case se := <-sub.events:
+			msg, err := json.Marshal(se)
+			if err != nil {
+				log.Printf("marshalling event for SSE: %s", err)
+				continue
+			}
+			fmt.Fprintf(resp, "data: %s\n\n", msg)
+			flusher.Flush()
+		case <-ticker.C:
+			fmt.Fprint(resp, ": ping\n\n")
+			flusher.Flush()
+		case <-sub.done:
+			return
+		case <-request.Context().Done():
+			return
+		}
+	}
+}
+
+func (e *EventsHandler) serveWebSocket(resp http.ResponseWriter, request *http.Request, sub *Subscriber) {
+	conn, err := e.upgrader.Upgrade(resp, request, nil)
+	if err != nil {
+		log.Printf("upgrading websocket connection: %s", err)
+		return
+	}
+	defer conn.Close()
+
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case se := <-sub.events:
+			if err := conn.WriteJSON(se); err != nil {
+				log.Printf("writing event to websocket: %s", err)
+				return
+			}
+		case <-ticker.C:
+			deadline := time.Now().Add(5 * time.Second)
+			if err := conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				return
+			}
+		case <-sub.done:
+			deadline := time.Now().Add(5 * time.Second)
+			closeMsg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+			conn.WriteControl(websocket.CloseMessage, closeMsg, deadline)
+			return
+		}
+	}
+}
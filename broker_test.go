@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBrokerSubscribeAndPublish(t *testing.T) {
+	cbs := NewCallbackStore()
+	broker := NewBroker(cbs)
+	sub := broker.Subscribe("/foo")
+	defer broker.Unsubscribe(sub)
+
+	broker.Publish(SendableEvent{Path: "/foo", Event: "Create"})
+
+	select {
+	case se := <-sub.events:
+		if se.Path != "/foo" {
+			t.Errorf("Path was %s, not /foo", se.Path)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("subscriber did not receive the published event")
+	}
+}
+
+func TestBrokerPublishNonMatchingPattern(t *testing.T) {
+	cbs := NewCallbackStore()
+	broker := NewBroker(cbs)
+	sub := broker.Subscribe("/bar")
+	defer broker.Unsubscribe(sub)
+
+	broker.Publish(SendableEvent{Path: "/foo", Event: "Create"})
+
+	select {
+	case se := <-sub.events:
+		t.Errorf("subscriber should not have received %v", se)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestEventsHandlerDefaultPatternMatchesDeepPaths(t *testing.T) {
+	cbs := NewCallbackStore()
+	broker := NewBroker(cbs)
+	handler := NewEventsHandler(broker)
+
+	// As mounted behind http.StripPrefix("/events/", ...), an unqualified
+	// request to /events/ arrives here with an empty path, which should
+	// subscribe to everything, not just one path segment deep.
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	req.URL.Path = ""
+	resp := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		handler.ServeHTTP(resp, req)
+		close(done)
+	}()
+
+	// Give ServeHTTP a moment to subscribe before publishing.
+	time.Sleep(10 * time.Millisecond)
+	broker.Publish(SendableEvent{Path: "logs/sub/foo.json", Event: "Create"})
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	<-done
+
+	if !strings.Contains(resp.Body.String(), "logs/sub/foo.json") {
+		t.Errorf("expected the default subscription to match a deeply nested path, body: %s", resp.Body.String())
+	}
+}
+
+func TestBrokerUnsubscribe(t *testing.T) {
+	cbs := NewCallbackStore()
+	broker := NewBroker(cbs)
+	sub := broker.Subscribe("/foo")
+	broker.Unsubscribe(sub)
+
+	select {
+	case <-sub.done:
+	case <-time.After(time.Second):
+		t.Errorf("done channel was not closed after Unsubscribe")
+	}
+}
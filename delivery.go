@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// Delivery backoff and pool tuning.
+const (
+	deliveryBaseBackoff = time.Second
+	deliveryMaxBackoff  = 5 * time.Minute
+	deliveryMaxRetries  = 8
+	deliveryWorkers     = 8
+	deliveryQueueSize   = 1024
+)
+
+// deliveryJob is a single callback POST waiting to be attempted. onDone, if
+// set, is called once the job reaches a terminal state (delivered, or
+// given up on) so a durable Deliverer can drop its persisted record.
+type deliveryJob struct {
+	URL     string
+	Secret  string
+	Event   *SendableEvent
+	Attempt int
+	onDone  func()
+}
+
+// deliveryStat tracks the outcome of deliveries to a single callback URL.
+type deliveryStat struct {
+	Successes int       `json:"successes"`
+	Failures  int       `json:"failures"`
+	LastError string    `json:"lastError,omitempty"`
+	LastTry   time.Time `json:"lastTry"`
+}
+
+// DeliveryReport is the JSON snapshot returned by Deliverer.Stats and
+// served at /deliveries/.
+type DeliveryReport struct {
+	QueueDepth int                     `json:"queueDepth"`
+	ByURL      map[string]deliveryStat `json:"byURL"`
+}
+
+// Deliverer delivers SendableEvents to callback URLs, retrying failed
+// attempts according to its own backoff policy, and reports on its queue
+// and per-URL history. CallbackStore.Trigger hands jobs to a Deliverer
+// instead of POSTing them directly. When secret is non-empty, the
+// Deliverer signs the request with an HMAC-SHA256 so the receiver can
+// call Verify to authenticate it.
+type Deliverer interface {
+	Enqueue(url, secret string, se *SendableEvent) error
+	Stats() DeliveryReport
+}
+
+// QueueDeliverer is an in-memory Deliverer backed by a bounded worker
+// pool. Jobs that fail with a retryable error are re-enqueued after an
+// exponential backoff with jitter; anything else is dropped after being
+// recorded in Stats.
+type QueueDeliverer struct {
+	jobs   chan deliveryJob
+	lock   *sync.Mutex
+	stats  map[string]deliveryStat
+	client *http.Client
+}
+
+// NewQueueDeliverer starts a QueueDeliverer with workers goroutines
+// consuming from a queue that holds up to depth pending jobs.
+func NewQueueDeliverer(workers, depth int) *QueueDeliverer {
+	d := &QueueDeliverer{
+		jobs:   make(chan deliveryJob, depth),
+		lock:   &sync.Mutex{},
+		stats:  make(map[string]deliveryStat),
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+	for i := 0; i < workers; i++ {
+		go d.worker()
+	}
+	return d
+}
+
+// Enqueue adds a delivery job for url to the queue, signed with secret if
+// it's non-empty.
+func (d *QueueDeliverer) Enqueue(url, secret string, se *SendableEvent) error {
+	return d.enqueueJob(deliveryJob{URL: url, Secret: secret, Event: se})
+}
+
+// Stats returns a snapshot of the current queue depth and per-URL counters.
+func (d *QueueDeliverer) Stats() DeliveryReport {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	byURL := make(map[string]deliveryStat, len(d.stats))
+	for url, stat := range d.stats {
+		byURL[url] = stat
+	}
+	return DeliveryReport{
+		QueueDepth: len(d.jobs),
+		ByURL:      byURL,
+	}
+}
+
+func (d *QueueDeliverer) enqueueJob(job deliveryJob) error {
+	select {
+	case d.jobs <- job:
+		return nil
+	default:
+		return fmt.Errorf("delivery queue is full, dropping event for %s", job.URL)
+	}
+}
+
+func (d *QueueDeliverer) worker() {
+	for job := range d.jobs {
+		d.attempt(job)
+	}
+}
+
+func (d *QueueDeliverer) attempt(job deliveryJob) {
+	msg, err := json.Marshal(job.Event)
+	if err != nil {
+		log.Printf("marshalling event for %s: %s", job.URL, err)
+		d.finish(job)
+		return
+	}
+	req, err := http.NewRequest("POST", job.URL, bytes.NewBuffer(msg))
+	if err != nil {
+		d.recordFailure(job.URL, err.Error())
+		d.finish(job)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if job.Secret != "" {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(timestampHeader, ts)
+		req.Header.Set(signatureHeader, "sha256="+sign(job.Secret, ts, msg))
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		d.retryOrDrop(job, err.Error())
+		return
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		d.recordSuccess(job.URL)
+		d.finish(job)
+		return
+	}
+	if !retryableStatus(resp.StatusCode) {
+		d.recordFailure(job.URL, fmt.Sprintf("status %d: %s", resp.StatusCode, body))
+		d.finish(job)
+		return
+	}
+	d.retryOrDrop(job, fmt.Sprintf("status %d: %s", resp.StatusCode, body))
+}
+
+// retryableStatus reports whether a response status code warrants a retry:
+// every 5xx, plus 408 (timeout) and 429 (rate limited). Any other 4xx is
+// treated as permanent and is not retried.
+func retryableStatus(status int) bool {
+	if status >= 500 {
+		return true
+	}
+	return status == 408 || status == 429
+}
+
+// retryOrDrop records the failure and either schedules a backed-off retry
+// or, once deliveryMaxRetries is exceeded, gives up on the job.
+func (d *QueueDeliverer) retryOrDrop(job deliveryJob, lastErr string) {
+	job.Attempt++
+	d.recordFailure(job.URL, lastErr)
+	if job.Attempt > deliveryMaxRetries {
+		log.Printf("giving up on delivery to %s after %d attempts: %s", job.URL, job.Attempt, lastErr)
+		d.finish(job)
+		return
+	}
+	time.AfterFunc(deliveryBackoff(job.Attempt), func() {
+		if err := d.enqueueJob(job); err != nil {
+			log.Printf("retrying delivery to %s: %s", job.URL, err)
+			d.finish(job)
+		}
+	})
+}
+
+// deliveryBackoff returns the delay before retry attempt n, following
+// base 1s, factor 2, capped at deliveryMaxBackoff, with up to 20% jitter.
+func deliveryBackoff(attempt int) time.Duration {
+	backoff := deliveryBaseBackoff * time.Duration(int64(1)<<uint(attempt-1))
+	if backoff > deliveryMaxBackoff {
+		backoff = deliveryMaxBackoff
+	}
+	jitter := time.Duration(rand.Int63n(int64(backoff)/5 + 1))
+	return backoff + jitter
+}
+
+func (d *QueueDeliverer) finish(job deliveryJob) {
+	if job.onDone != nil {
+		job.onDone()
+	}
+}
+
+func (d *QueueDeliverer) recordSuccess(url string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	stat := d.stats[url]
+	stat.Successes++
+	stat.LastTry = time.Now()
+	stat.LastError = ""
+	d.stats[url] = stat
+}
+
+func (d *QueueDeliverer) recordFailure(url, lastErr string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	stat := d.stats[url]
+	stat.Failures++
+	stat.LastTry = time.Now()
+	stat.LastError = lastErr
+	d.stats[url] = stat
+}
+
+// deliveryBucket is the BoltDB bucket DurableQueueDeliverer persists
+// pending jobs into.
+var deliveryBucket = []byte("pending-deliveries")
+
+// persistedJob is the JSON representation of a deliveryJob written to
+// BoltDB so it can be replayed after a restart.
+type persistedJob struct {
+	URL    string
+	Secret string
+	Event  SendableEvent
+}
+
+// DurableQueueDeliverer is a Deliverer that persists every enqueued job to
+// a BoltDB file before handing it to an in-memory QueueDeliverer, and
+// removes the persisted record once the job reaches a terminal state.
+// This lets pending deliveries survive a process restart.
+type DurableQueueDeliverer struct {
+	*QueueDeliverer
+	db *bbolt.DB
+}
+
+// NewDurableQueueDeliverer opens (creating if necessary) a BoltDB file at
+// dbPath, replays any jobs left pending from a previous run, and starts
+// workers goroutines to process new ones.
+func NewDurableQueueDeliverer(dbPath string, workers, depth int) (*DurableQueueDeliverer, error) {
+	db, err := bbolt.Open(dbPath, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(deliveryBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	d := &DurableQueueDeliverer{
+		QueueDeliverer: NewQueueDeliverer(workers, depth),
+		db:             db,
+	}
+	if err := d.replay(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Enqueue persists the job before handing it to the in-memory queue, so
+// it isn't lost if the process dies before delivery succeeds.
+func (d *DurableQueueDeliverer) Enqueue(url, secret string, se *SendableEvent) error {
+	key, err := d.persist(url, secret, se)
+	if err != nil {
+		return err
+	}
+	job := deliveryJob{
+		URL:    url,
+		Secret: secret,
+		Event:  se,
+		onDone: d.forgetter(key),
+	}
+	return d.enqueueJob(job)
+}
+
+// Close releases the underlying BoltDB file.
+func (d *DurableQueueDeliverer) Close() error {
+	return d.db.Close()
+}
+
+func (d *DurableQueueDeliverer) persist(url, secret string, se *SendableEvent) ([]byte, error) {
+	var key []byte
+	err := d.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(deliveryBucket)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		key = []byte(fmt.Sprintf("%020d", seq))
+		data, err := json.Marshal(persistedJob{URL: url, Secret: secret, Event: *se})
+		if err != nil {
+			return err
+		}
+		return b.Put(key, data)
+	})
+	return key, err
+}
+
+// forgetter returns an onDone callback that removes key's persisted
+// record.
+func (d *DurableQueueDeliverer) forgetter(key []byte) func() {
+	return func() {
+		err := d.db.Update(func(tx *bbolt.Tx) error {
+			return tx.Bucket(deliveryBucket).Delete(key)
+		})
+		if err != nil {
+			log.Printf("removing persisted delivery %x: %s", key, err)
+		}
+	}
+}
+
+// replay re-enqueues every job still in the bucket, e.g. left over from a
+// crash or restart while deliveries were pending.
+func (d *DurableQueueDeliverer) replay() error {
+	return d.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(deliveryBucket).ForEach(func(k, v []byte) error {
+			var pj persistedJob
+			if err := json.Unmarshal(v, &pj); err != nil {
+				return err
+			}
+			key := append([]byte{}, k...)
+			se := pj.Event
+			job := deliveryJob{
+				URL:    pj.URL,
+				Secret: pj.Secret,
+				Event:  &se,
+				onDone: d.forgetter(key),
+			}
+			return d.enqueueJob(job)
+		})
+	})
+}
+
+// DeliveriesHandler reports a Deliverer's queue depth and per-URL
+// delivery history at /deliveries/.
+type DeliveriesHandler struct {
+	deliverer Deliverer
+}
+
+// NewDeliveriesHandler returns a *DeliveriesHandler backed by d.
+func NewDeliveriesHandler(d Deliverer) *DeliveriesHandler {
+	return &DeliveriesHandler{deliverer: d}
+}
+
+// ServeHTTP writes the Deliverer's current DeliveryReport as JSON.
+func (d *DeliveriesHandler) ServeHTTP(resp http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		http.Error(resp, "Not Found!", 404)
+		return
+	}
+	marshalled, err := json.Marshal(d.deliverer.Stats())
+	if err != nil {
+		http.Error(resp, err.Error(), 500)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(marshalled)
+}
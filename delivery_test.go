@@ -0,0 +1,136 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQueueDelivererSuccess(t *testing.T) {
+	delivered := make(chan int, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delivered <- 1
+	}))
+	defer ts.Close()
+
+	d := NewQueueDeliverer(1, 4)
+	se := &SendableEvent{Path: "/foo", Event: "Create"}
+	if err := d.Enqueue(ts.URL, "", se); err != nil {
+		t.Fatalf("Enqueue returned an error: %s", err)
+	}
+
+	select {
+	case <-delivered:
+	case <-time.After(time.Second):
+		t.Fatalf("event was never delivered")
+	}
+
+	// give the worker a moment to record the success before reading it back
+	time.Sleep(10 * time.Millisecond)
+	stats := d.Stats()
+	if stats.ByURL[ts.URL].Successes != 1 {
+		t.Errorf("expected 1 success, got %d", stats.ByURL[ts.URL].Successes)
+	}
+}
+
+func TestQueueDelivererDropsOnPermanentFailure(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", 400)
+	}))
+	defer ts.Close()
+
+	d := NewQueueDeliverer(1, 4)
+	se := &SendableEvent{Path: "/foo", Event: "Create"}
+	if err := d.Enqueue(ts.URL, "", se); err != nil {
+		t.Fatalf("Enqueue returned an error: %s", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if d.Stats().ByURL[ts.URL].Failures > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stats := d.Stats()
+	if stats.ByURL[ts.URL].Failures != 1 {
+		t.Errorf("expected 1 failure, got %d", stats.ByURL[ts.URL].Failures)
+	}
+}
+
+func TestDurableQueueDelivererReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsserver-delivery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dbPath := filepath.Join(dir, "deliveries.db")
+
+	// An address nothing is listening on, so every attempt fails with a
+	// retryable network error and the persisted record is never forgotten.
+	const unreachable = "http://127.0.0.1:1"
+
+	d1, err := NewDurableQueueDeliverer(dbPath, 1, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	se := &SendableEvent{Path: "/foo", Event: "Create"}
+	if err := d1.Enqueue(unreachable, "", se); err != nil {
+		t.Fatalf("Enqueue returned an error: %s", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if d1.Stats().ByURL[unreachable].Failures > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if d1.Stats().ByURL[unreachable].Failures == 0 {
+		t.Fatalf("first attempt never failed")
+	}
+
+	// Simulate a crash: close the BoltDB file without the job ever
+	// reaching a terminal state, so its persisted record survives.
+	if err := d1.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	d2, err := NewDurableQueueDeliverer(dbPath, 1, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d2.Close()
+
+	deadline = time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if d2.Stats().ByURL[unreachable].Failures > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if d2.Stats().ByURL[unreachable].Failures == 0 {
+		t.Errorf("replay did not re-enqueue the pending job after reopening the store")
+	}
+}
+
+func TestRetryableStatus(t *testing.T) {
+	cases := map[int]bool{
+		200: false,
+		400: false,
+		404: false,
+		408: true,
+		429: true,
+		500: true,
+		503: true,
+	}
+	for status, want := range cases {
+		if got := retryableStatus(status); got != want {
+			t.Errorf("retryableStatus(%d) = %v, want %v", status, got, want)
+		}
+	}
+}
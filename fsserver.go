@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"database/sql"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -11,6 +12,7 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
 	"sync"
 
@@ -43,17 +45,48 @@ type SendableEvent struct {
 type CallbackStorer interface {
 	Set(string, string)
 	Get(string) []string
-	Trigger(string) error
+	Trigger(string, *SendableEvent) error
+	Delete(string, string) error
+	List() map[string][]string
+	SetSecret(string, string) error
 }
 
-// CallbackStore is an in-memory implementation of CallbackStorer.
+// CallbackStore is an in-memory implementation of CallbackStorer. Exact
+// paths are kept in storage; glob patterns (anything containing "*", "?",
+// or "[") are kept separately in patterns since they can't be looked up
+// with a plain map index and instead have to be matched against every
+// triggered path.
 type CallbackStore struct {
-	storage map[string][]string
-	lock    *sync.RWMutex //Synchronized reads/writes to storage
-	base    string        //base directory for the callback paths.
+	storage       map[string][]string
+	patterns      map[string][]string
+	lock          *sync.RWMutex //Synchronized reads/writes to storage, patterns, and secrets
+	base          string        //base directory for the callback paths.
+	deliverer     Deliverer
+	secrets       map[string]string //per-callback-URL HMAC secrets, set via SetSecret
+	defaultSecret string            //used to sign deliveries to URLs with no secret of their own
 }
 
-// Set associates a callback with a path. Neither path or callback are currently
+// SetSecret stores the HMAC secret used to sign deliveries sent to cb.
+func (c *CallbackStore) SetSecret(cb, secret string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.secrets[cb] = secret
+	return nil
+}
+
+// secretFor returns the HMAC secret configured for cb, falling back to
+// the store's default secret if cb has none of its own.
+func (c *CallbackStore) secretFor(cb string) string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if secret, ok := c.secrets[cb]; ok {
+		return secret
+	}
+	return c.defaultSecret
+}
+
+// Set associates a callback with a path or glob pattern (e.g.
+// "logs/**/*.json"). Neither path/pattern or callback are currently
 // validated. Not validating the path allows callers to set a callback for a
 // path that doesn't exist yet.
 func (c *CallbackStore) Set(cbpath string, cb string) {
@@ -62,17 +95,22 @@ func (c *CallbackStore) Set(cbpath string, cb string) {
 	if !strings.HasPrefix(cbpath, c.base) {
 		cbpath = path.Join(c.base, cbpath)
 	}
-	cbs, ok := c.storage[cbpath]
+	storage := c.storage
+	if isPattern(cbpath) {
+		storage = c.patterns
+	}
+	cbs, ok := storage[cbpath]
 	if !ok {
-		c.storage[cbpath] = make([]string, 0)
-		cbs = c.storage[cbpath]
+		storage[cbpath] = make([]string, 0)
+		cbs = storage[cbpath]
 	}
 	cbs = append(cbs, cb)
-	c.storage[cbpath] = cbs
+	storage[cbpath] = cbs
 }
 
-// Get returns a []string containing the callback URLs (as strings) for the
-// given path.
+// Get returns a []string containing the callback URLs (as strings)
+// registered for the exact given path. It does not match cbpath against
+// registered glob patterns; use Trigger for that.
 func (c *CallbackStore) Get(cbpath string) []string {
 	c.lock.RLock()
 	defer c.lock.RUnlock()
@@ -87,57 +125,103 @@ func (c *CallbackStore) Get(cbpath string) []string {
 	return cbs
 }
 
-// Trigger will cause a JSON-encoded the SendableEvent to be sent to the
-// callback URLs associated with the given path. The requests are POSTs and they
-// are performed asynchronously.
-func (c *CallbackStore) Trigger(cbpath string, se *SendableEvent) error {
+// Delete removes a single callback URL registered for the exact path or
+// pattern cbpath. It's a no-op if that URL wasn't registered.
+func (c *CallbackStore) Delete(cbpath, cb string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	if !strings.HasPrefix(cbpath, c.base) {
 		cbpath = path.Join(c.base, cbpath)
 	}
-	cbs := c.Get(cbpath)
-	msg, err := json.Marshal(se)
-	if err != nil {
-		return err
+	storage := c.storage
+	if isPattern(cbpath) {
+		storage = c.patterns
 	}
-	go func() {
-		for _, cb := range cbs {
-			resp, err := http.Post(cb, "application/json", bytes.NewBuffer(msg))
-			if err != nil {
-				log.Printf(err.Error())
-			} else {
-				body, err := ioutil.ReadAll(resp.Body)
-				if err != nil {
-					log.Printf(err.Error())
-				}
-				log.Printf(
-					"Path: %s\nURL:%s\nStatus: %d\nBody:\n%s\n",
-					cbpath,
-					cb,
-					resp.StatusCode,
-					string(body[:]),
-				)
-			}
+	cbs, ok := storage[cbpath]
+	if !ok {
+		return nil
+	}
+	filtered := cbs[:0]
+	for _, existing := range cbs {
+		if existing != cb {
+			filtered = append(filtered, existing)
 		}
-	}()
-	return err
+	}
+	storage[cbpath] = filtered
+	return nil
+}
+
+// List returns every registered path and pattern along with its callback
+// URLs, for operators to inspect and prune registrations.
+func (c *CallbackStore) List() map[string][]string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	all := make(map[string][]string, len(c.storage)+len(c.patterns))
+	for p, cbs := range c.storage {
+		all[p] = append([]string{}, cbs...)
+	}
+	for p, cbs := range c.patterns {
+		all[p] = append([]string{}, cbs...)
+	}
+	return all
 }
 
-// CallbackHandler implements the HTTP request handling for the embedded
-// CallbackStore. That means you can call all of the CallbackStore methods on
-// an instance of CallbackHandler.
+// matching returns the callback URLs registered for the exact given path
+// plus every callback registered under a pattern that cbpath matches.
+func (c *CallbackStore) matching(cbpath string) []string {
+	cbs := append([]string{}, c.Get(cbpath)...)
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	for pattern, patternCbs := range c.patterns {
+		if matchGlob(pattern, cbpath) {
+			cbs = append(cbs, patternCbs...)
+		}
+	}
+	return cbs
+}
+
+// Trigger hands the SendableEvent off to the store's Deliverer for every
+// callback URL associated with the given path, either directly or through
+// a matching glob pattern. Delivery itself, including retries, happens
+// asynchronously in the Deliverer.
+func (c *CallbackStore) Trigger(cbpath string, se *SendableEvent) error {
+	if !strings.HasPrefix(cbpath, c.base) {
+		cbpath = path.Join(c.base, cbpath)
+	}
+	for _, cb := range c.matching(cbpath) {
+		if err := c.deliverer.Enqueue(cb, c.secretFor(cb), se); err != nil {
+			log.Printf("enqueueing delivery of %s to %s: %s", cbpath, cb, err)
+		}
+	}
+	return nil
+}
+
+// CallbackHandler implements the HTTP request handling on top of a
+// CallbackStorer, so the same handler works regardless of which storage
+// backend (in-memory, BoltDB, SQL, ...) main wires in.
 type CallbackHandler struct {
-	CallbackStore
+	store CallbackStorer
 }
 
-// NewCallbackHandler returns a pointer to a new instance of CallbackHandler.
-func NewCallbackHandler() *CallbackHandler {
-	ch := &CallbackHandler{
-		CallbackStore{
-			storage: make(map[string][]string, 0),
-			lock:    &sync.RWMutex{},
-		},
-	}
-	return ch
+// NewCallbackHandler returns a pointer to a new instance of CallbackHandler
+// backed by store.
+func NewCallbackHandler(store CallbackStorer) *CallbackHandler {
+	return &CallbackHandler{store: store}
+}
+
+// NewMemoryCallbackStore returns an in-memory CallbackStore that delivers
+// through deliverer. defaultSecret, if non-empty, is used to sign
+// deliveries to any callback that doesn't have its own secret set via
+// SetSecret.
+func NewMemoryCallbackStore(defaultSecret string, deliverer Deliverer) *CallbackStore {
+	return &CallbackStore{
+		storage:       make(map[string][]string, 0),
+		patterns:      make(map[string][]string, 0),
+		lock:          &sync.RWMutex{},
+		deliverer:     deliverer,
+		secrets:       make(map[string]string, 0),
+		defaultSecret: defaultSecret,
+	}
 }
 
 // Getter handles HTTP requests for getting the callbacks associated with a
@@ -147,8 +231,17 @@ func (c *CallbackHandler) Getter(resp http.ResponseWriter, request *http.Request
 		http.Error(resp, "Not Found!", 404)
 		return
 	}
+	if request.URL.Query().Get("list") != "" {
+		marshalled, err := json.Marshal(c.store.List())
+		if err != nil {
+			http.Error(resp, err.Error(), 500)
+			return
+		}
+		io.Copy(resp, bytes.NewBuffer(marshalled))
+		return
+	}
 	path := request.URL.Path
-	cbs := c.Get(path)
+	cbs := c.store.Get(path)
 	marshalled, err := json.Marshal(cbs)
 	if err != nil {
 		http.Error(resp, err.Error(), 500)
@@ -158,8 +251,9 @@ func (c *CallbackHandler) Getter(resp http.ResponseWriter, request *http.Request
 }
 
 type setCallback struct {
-	Path string
-	URL  string
+	Path   string
+	URL    string
+	Secret string //optional, overrides the server's default HMAC secret for this URL
 }
 
 // Setter handles HTTP requests for setting the callbacks associated with a
@@ -184,32 +278,69 @@ func (c *CallbackHandler) Setter(resp http.ResponseWriter, request *http.Request
 		http.Error(resp, err.Error(), 500)
 		return
 	}
-	c.Set(setter.Path, setter.URL)
+	c.store.Set(setter.Path, setter.URL)
+	if setter.Secret != "" {
+		if err := c.store.SetSecret(setter.URL, setter.Secret); err != nil {
+			http.Error(resp, err.Error(), 500)
+			return
+		}
+	}
+}
+
+// Deleter handles HTTP requests for removing a single callback URL
+// registered for a path, so operators can prune stale registrations.
+func (c *CallbackHandler) Deleter(resp http.ResponseWriter, request *http.Request) {
+	if request.Method != "DELETE" {
+		http.Error(resp, "Not Found!", 404)
+		return
+	}
+	if request.Body == nil {
+		http.Error(resp, "Body was empty.", 500)
+		return
+	}
+	var setter setCallback
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		http.Error(resp, err.Error(), 500)
+		return
+	}
+	if err := json.Unmarshal(body, &setter); err != nil {
+		http.Error(resp, err.Error(), 500)
+		return
+	}
+	if err := c.store.Delete(setter.Path, setter.URL); err != nil {
+		http.Error(resp, err.Error(), 500)
+		return
+	}
 }
 
-// Route implements the logic for delegating a request to either Setter() or
-// Getter().
+// ServeHTTP implements the logic for delegating a request to Setter(),
+// Getter(), or Deleter().
 func (c *CallbackHandler) ServeHTTP(resp http.ResponseWriter, request *http.Request) {
 	switch request.Method {
 	case "GET":
 		c.Getter(resp, request)
 	case "POST":
 		c.Setter(resp, request)
+	case "DELETE":
+		c.Deleter(resp, request)
 	default:
 		http.Error(resp, "Not Found!", 404)
 		return
 	}
 }
 
-// Monitor creates a fsnotify.Watcher for the given path and sends
-// SendableEvents out on the provided out channel.
-func Monitor(path string, out chan<- SendableEvent) error {
-	exists, err := PathExists(path)
+// Monitor creates a fsnotify.Watcher for the given root and, recursively,
+// every directory beneath it, sending SendableEvents out on the provided
+// out channel. Directories created under root are watched as they appear;
+// directories that are deleted or renamed away have their watch removed.
+func Monitor(root string, out chan<- SendableEvent) error {
+	exists, err := PathExists(root)
 	if err != nil {
 		return err
 	}
 	if !exists {
-		return fmt.Errorf("%s does not exist", path)
+		return fmt.Errorf("%s does not exist", root)
 	}
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
@@ -219,8 +350,18 @@ func Monitor(path string, out chan<- SendableEvent) error {
 		for {
 			select {
 			case event := <-watcher.Event:
+				if event.IsCreate() {
+					if info, statErr := os.Stat(event.Name); statErr == nil && info.IsDir() {
+						if err := watchTree(watcher, event.Name); err != nil {
+							log.Println(err)
+						}
+					}
+				}
+				if event.IsDelete() || event.IsRename() {
+					watcher.RemoveWatch(event.Name)
+				}
 				sendable := SendableEvent{
-					Path:  strings.TrimPrefix(strings.TrimPrefix(event.Name, path), "/"),
+					Path:  strings.TrimPrefix(strings.TrimPrefix(event.Name, root), "/"),
 					Event: StringifyEvent(event),
 				}
 				out <- sendable
@@ -229,8 +370,21 @@ func Monitor(path string, out chan<- SendableEvent) error {
 			}
 		}
 	}()
-	err = watcher.Watch(path)
-	return err
+	return watchTree(watcher, root)
+}
+
+// watchTree walks root and adds a fsnotify watch for every directory found,
+// including root itself.
+func watchTree(watcher *fsnotify.Watcher, root string) error {
+	return filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		return watcher.Watch(p)
+	})
 }
 
 // StringifyEvent translates a *fsnotify.FileEvent into a string. Useful for
@@ -257,8 +411,22 @@ func StringifyEvent(event *fsnotify.FileEvent) string {
 func main() {
 	var path string
 	var port string
+	var token string
+	var secret string
+	var store string
+	var storePath string
+	var sqlDriver string
+	var deliveryStore string
+	var deliveryStorePath string
 	flag.StringVar(&path, "path", "", "The path to watch")
 	flag.StringVar(&port, "port", "8080", "The port to listen on.")
+	flag.StringVar(&token, "token", "", "Bearer token accepted on /callbacks/ and /files/ requests, in addition to a signed request. Leave empty, along with -secret, to disable auth.")
+	flag.StringVar(&secret, "secret", "", "Default HMAC secret used with -store=memory to sign outgoing webhooks that don't have their own secret (the bolt and sql stores sign only with per-callback secrets), and to verify incoming signed requests to /callbacks/ and /files/.")
+	flag.StringVar(&store, "store", "memory", "Callback storage backend to use: memory, bolt, or sql.")
+	flag.StringVar(&storePath, "store-path", "fsserver-callbacks.db", "BoltDB file path (-store=bolt) or database/sql data source name (-store=sql).")
+	flag.StringVar(&sqlDriver, "sql-driver", "sqlite3", "database/sql driver name to use with -store=sql.")
+	flag.StringVar(&deliveryStore, "delivery-store", "memory", "Delivery queue backend to use: memory, or bolt to persist pending deliveries across restarts.")
+	flag.StringVar(&deliveryStorePath, "delivery-store-path", "fsserver-deliveries.db", "BoltDB file path for the pending delivery queue (-delivery-store=bolt).")
 	flag.Parse()
 	if path == "" {
 		log.Fatal("Path was not set.")
@@ -266,14 +434,51 @@ func main() {
 	if !strings.HasPrefix(port, ":") {
 		port = ":" + port
 	}
-	handler := NewCallbackHandler()
+	var deliverer Deliverer
+	switch deliveryStore {
+	case "memory":
+		deliverer = NewQueueDeliverer(deliveryWorkers, deliveryQueueSize)
+	case "bolt":
+		durable, err := NewDurableQueueDeliverer(deliveryStorePath, deliveryWorkers, deliveryQueueSize)
+		if err != nil {
+			log.Fatal(err)
+		}
+		deliverer = durable
+	default:
+		log.Fatalf("unknown -delivery-store backend %q", deliveryStore)
+	}
+	var callbackStore CallbackStorer
+	switch store {
+	case "memory":
+		callbackStore = NewMemoryCallbackStore(secret, deliverer)
+	case "bolt":
+		boltStore, err := NewBoltCallbackStore(storePath, deliverer)
+		if err != nil {
+			log.Fatal(err)
+		}
+		callbackStore = boltStore
+	case "sql":
+		db, err := sql.Open(sqlDriver, storePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sqlStore, err := NewSQLCallbackStore(db, deliverer)
+		if err != nil {
+			log.Fatal(err)
+		}
+		callbackStore = sqlStore
+	default:
+		log.Fatalf("unknown -store backend %q", store)
+	}
+	handler := NewCallbackHandler(callbackStore)
+	broker := NewBroker(callbackStore)
 	in := make(chan SendableEvent)
 	go func() {
 		for {
 			select {
 			case se := <-in:
 				log.Printf("%s\t%s\n", se.Event, se.Path)
-				handler.Trigger(se.Path, &se)
+				broker.Publish(se)
 			}
 		}
 	}()
@@ -284,11 +489,19 @@ func main() {
 	go func() {
 		http.Handle(
 			"/callbacks/",
-			http.StripPrefix("/callbacks/", handler),
+			http.StripPrefix("/callbacks/", RequireAuth(handler, token, secret)),
+		)
+		http.Handle(
+			"/events/",
+			http.StripPrefix("/events/", RequireBearerToken(NewEventsHandler(broker), token)),
+		)
+		http.Handle(
+			"/deliveries/",
+			http.StripPrefix("/deliveries/", RequireBearerToken(NewDeliveriesHandler(deliverer), token)),
 		)
 		http.Handle(
 			"/files/",
-			http.StripPrefix("/files/", http.FileServer(http.Dir(path))),
+			http.StripPrefix("/files/", RequireAuth(NewFilesHandler(path, broker), token, secret)),
 		)
 		log.Fatal(http.ListenAndServe(port, nil))
 	}()
@@ -14,8 +14,10 @@ import (
 
 func NewCallbackStore() *CallbackStore {
 	return &CallbackStore{
-		storage: make(map[string][]string, 0),
-		lock:    &sync.RWMutex{},
+		storage:   make(map[string][]string, 0),
+		patterns:  make(map[string][]string, 0),
+		lock:      &sync.RWMutex{},
+		deliverer: NewQueueDeliverer(deliveryWorkers, deliveryQueueSize),
 	}
 }
 
@@ -72,8 +74,12 @@ func TestCallbackStoreTrigger(t *testing.T) {
 	}
 }
 
+func newTestCallbackHandler() *CallbackHandler {
+	return NewCallbackHandler(NewMemoryCallbackStore("", NewQueueDeliverer(deliveryWorkers, deliveryQueueSize)))
+}
+
 func TestNewCallbackHandler(t *testing.T) {
-	cbh := NewCallbackHandler()
+	cbh := newTestCallbackHandler()
 	if cbh == nil {
 		t.Errorf("NewCallbackHandler returned nil.")
 	}
@@ -84,7 +90,7 @@ func TestNewCallbackHandler(t *testing.T) {
 }
 
 func TestSetter(t *testing.T) {
-	cbh := NewCallbackHandler()
+	cbh := newTestCallbackHandler()
 	if cbh == nil {
 		t.Errorf("NewCallbackHandler returned nil.")
 	}
@@ -101,11 +107,11 @@ func TestSetter(t *testing.T) {
 }
 
 func TestGetter(t *testing.T) {
-	cbh := NewCallbackHandler()
+	cbh := newTestCallbackHandler()
 	if cbh == nil {
 		t.Errorf("NewCallbackHandler returned nil.")
 	}
-	cbh.Set("/foo", "wut")
+	cbh.store.Set("/foo", "wut")
 	recorder := httptest.NewRecorder()
 	request, err := http.NewRequest("GET", "http://itdoesntmatter.lol/foo", nil)
 	if err != nil {
@@ -125,11 +131,11 @@ func TestGetter(t *testing.T) {
 }
 
 func TestServeHTTP1(t *testing.T) {
-	cbh := NewCallbackHandler()
+	cbh := newTestCallbackHandler()
 	if cbh == nil {
 		t.Errorf("NewCallbackHandler returned nil.")
 	}
-	cbh.Set("/foo", "wut")
+	cbh.store.Set("/foo", "wut")
 	recorder := httptest.NewRecorder()
 	request, err := http.NewRequest("GET", "http://itdoesntmatter.lol/foo", nil)
 	if err != nil {
@@ -148,7 +154,7 @@ func TestServeHTTP1(t *testing.T) {
 }
 
 func TestServeHTTP2(t *testing.T) {
-	cbh := NewCallbackHandler()
+	cbh := newTestCallbackHandler()
 	if cbh == nil {
 		t.Errorf("NewCallbackHandler returned nil.")
 	}
@@ -165,7 +171,7 @@ func TestServeHTTP2(t *testing.T) {
 }
 
 func TestServeHTTP3(t *testing.T) {
-	cbh := NewCallbackHandler()
+	cbh := newTestCallbackHandler()
 	if cbh == nil {
 		t.Errorf("NewCallbackHandler returned nil.")
 	}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"path"
+	"strings"
+)
+
+// isPattern returns true if p contains any glob metacharacters and should be
+// matched with matchGlob instead of treated as an exact path.
+func isPattern(p string) bool {
+	return strings.ContainsAny(p, "*?[")
+}
+
+// matchGlob reports whether name matches pattern, where pattern may use the
+// same single-segment wildcards as path.Match ("*", "?", "[...]") plus "**"
+// to match zero or more arbitrary path segments, e.g. "logs/**/*.json" or
+// "uploads/*/thumbnail.png".
+func matchGlob(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+// matchSegments recursively matches "/"-separated pattern and name
+// segments, expanding "**" to zero or more name segments.
+func matchSegments(patternSegs, nameSegs []string) bool {
+	if len(patternSegs) == 0 {
+		return len(nameSegs) == 0
+	}
+	if patternSegs[0] == "**" {
+		if matchSegments(patternSegs[1:], nameSegs) {
+			return true
+		}
+		if len(nameSegs) == 0 {
+			return false
+		}
+		return matchSegments(patternSegs, nameSegs[1:])
+	}
+	if len(nameSegs) == 0 {
+		return false
+	}
+	matched, err := path.Match(patternSegs[0], nameSegs[0])
+	if err != nil || !matched {
+		return false
+	}
+	return matchSegments(patternSegs[1:], nameSegs[1:])
+}
@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestIsPattern(t *testing.T) {
+	if isPattern("/foo/bar") {
+		t.Errorf("/foo/bar should not be a pattern")
+	}
+	if !isPattern("logs/*.json") {
+		t.Errorf("logs/*.json should be a pattern")
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	cases := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"logs/*.json", "logs/foo.json", true},
+		{"logs/*.json", "logs/sub/foo.json", false},
+		{"logs/**/*.json", "logs/foo.json", true},
+		{"logs/**/*.json", "logs/a/b/c/foo.json", true},
+		{"logs/**/*.json", "logs/a/b/c/foo.txt", false},
+		{"uploads/*/thumbnail.png", "uploads/42/thumbnail.png", true},
+		{"uploads/*/thumbnail.png", "uploads/42/full.png", false},
+	}
+	for _, c := range cases {
+		if got := matchGlob(c.pattern, c.name); got != c.want {
+			t.Errorf("matchGlob(%q, %q) = %v, want %v", c.pattern, c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+
+	"go.etcd.io/bbolt"
+)
+
+// boltBucket holds exact-path registrations, keyed by watched path with a
+// JSON-encoded []boltCallback as the value. boltPatternBucket holds glob
+// registrations (e.g. "logs/**/*.json") the same way, kept separate since
+// they have to be matched against every triggered path instead of looked
+// up directly, mirroring CallbackStore's storage/patterns split.
+var (
+	boltBucket        = []byte("callbacks")
+	boltPatternBucket = []byte("patterns")
+)
+
+// boltCallback is one callback URL registered for a path, along with its
+// HMAC secret if it has one of its own.
+type boltCallback struct {
+	URL    string `json:"url"`
+	Secret string `json:"secret,omitempty"`
+}
+
+// BoltCallbackStore is a CallbackStorer backed by a single embedded
+// BoltDB file, so registrations survive a restart.
+type BoltCallbackStore struct {
+	db        *bbolt.DB
+	deliverer Deliverer
+}
+
+// NewBoltCallbackStore opens (creating if necessary) a BoltDB file at
+// dbPath and returns a *BoltCallbackStore that delivers through
+// deliverer.
+func NewBoltCallbackStore(dbPath string, deliverer Deliverer) (*BoltCallbackStore, error) {
+	db, err := bbolt.Open(dbPath, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(boltPatternBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &BoltCallbackStore{db: db, deliverer: deliverer}, nil
+}
+
+// Close releases the underlying BoltDB file.
+func (b *BoltCallbackStore) Close() error {
+	return b.db.Close()
+}
+
+func decodeBoltCallbacks(data []byte) ([]boltCallback, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	var cbs []boltCallback
+	if err := json.Unmarshal(data, &cbs); err != nil {
+		return nil, err
+	}
+	return cbs, nil
+}
+
+// bucketFor returns the bucket name cbpath belongs in: boltPatternBucket
+// for glob patterns, boltBucket for exact paths.
+func bucketFor(cbpath string) []byte {
+	if isPattern(cbpath) {
+		return boltPatternBucket
+	}
+	return boltBucket
+}
+
+// update reads the callbacks registered for cbpath, applies mutate, and
+// writes the result back in a single BoltDB transaction.
+func (b *BoltCallbackStore) update(cbpath string, mutate func([]boltCallback) []boltCallback) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(bucketFor(cbpath))
+		cbs, err := decodeBoltCallbacks(bucket.Get([]byte(cbpath)))
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(mutate(cbs))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(cbpath), data)
+	})
+}
+
+// Set associates cb with cbpath, persisting the registration.
+func (b *BoltCallbackStore) Set(cbpath, cb string) {
+	err := b.update(cbpath, func(cbs []boltCallback) []boltCallback {
+		return append(cbs, boltCallback{URL: cb})
+	})
+	if err != nil {
+		log.Printf("BoltCallbackStore.Set(%s, %s): %s", cbpath, cb, err)
+	}
+}
+
+// SetSecret stores the HMAC secret to sign deliveries to cb with,
+// updating every path cb is currently registered under, across both
+// buckets. BoltDB forbids mutating a bucket mid-ForEach, so the matching
+// entries are collected first and written back in a second pass.
+func (b *BoltCallbackStore) SetSecret(cb, secret string) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		for _, bucketName := range [][]byte{boltBucket, boltPatternBucket} {
+			bucket := tx.Bucket(bucketName)
+			type pending struct {
+				key  []byte
+				data []byte
+			}
+			var updates []pending
+			err := bucket.ForEach(func(k, v []byte) error {
+				cbs, err := decodeBoltCallbacks(v)
+				if err != nil {
+					return err
+				}
+				changed := false
+				for i, existing := range cbs {
+					if existing.URL == cb {
+						cbs[i].Secret = secret
+						changed = true
+					}
+				}
+				if !changed {
+					return nil
+				}
+				data, err := json.Marshal(cbs)
+				if err != nil {
+					return err
+				}
+				updates = append(updates, pending{key: append([]byte{}, k...), data: data})
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, u := range updates {
+				if err := bucket.Put(u.key, u.data); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Get returns the callback URLs registered for the exact path cbpath. It
+// does not match cbpath against registered glob patterns; use Trigger for
+// that.
+func (b *BoltCallbackStore) Get(cbpath string) []string {
+	var urls []string
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		cbs, err := decodeBoltCallbacks(tx.Bucket(boltBucket).Get([]byte(cbpath)))
+		if err != nil {
+			return err
+		}
+		for _, cb := range cbs {
+			urls = append(urls, cb.URL)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("BoltCallbackStore.Get(%s): %s", cbpath, err)
+	}
+	return urls
+}
+
+// Delete removes cb from the callbacks registered for the exact path or
+// pattern cbpath.
+func (b *BoltCallbackStore) Delete(cbpath, cb string) error {
+	return b.update(cbpath, func(cbs []boltCallback) []boltCallback {
+		filtered := cbs[:0]
+		for _, existing := range cbs {
+			if existing.URL != cb {
+				filtered = append(filtered, existing)
+			}
+		}
+		return filtered
+	})
+}
+
+// List returns every registered path and pattern along with its callback
+// URLs.
+func (b *BoltCallbackStore) List() map[string][]string {
+	all := make(map[string][]string)
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		for _, bucketName := range [][]byte{boltBucket, boltPatternBucket} {
+			err := tx.Bucket(bucketName).ForEach(func(k, v []byte) error {
+				cbs, err := decodeBoltCallbacks(v)
+				if err != nil {
+					return err
+				}
+				urls := make([]string, 0, len(cbs))
+				for _, cb := range cbs {
+					urls = append(urls, cb.URL)
+				}
+				all[string(k)] = urls
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("BoltCallbackStore.List(): %s", err)
+	}
+	return all
+}
+
+// matching returns the callback URLs registered for the exact path
+// cbpath plus every callback registered under a pattern that cbpath
+// matches.
+func (b *BoltCallbackStore) matching(cbpath string) ([]boltCallback, error) {
+	var matched []boltCallback
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		cbs, err := decodeBoltCallbacks(tx.Bucket(boltBucket).Get([]byte(cbpath)))
+		if err != nil {
+			return err
+		}
+		matched = append(matched, cbs...)
+		return tx.Bucket(boltPatternBucket).ForEach(func(k, v []byte) error {
+			if !matchGlob(string(k), cbpath) {
+				return nil
+			}
+			cbs, err := decodeBoltCallbacks(v)
+			if err != nil {
+				return err
+			}
+			matched = append(matched, cbs...)
+			return nil
+		})
+	})
+	return matched, err
+}
+
+// Trigger hands the SendableEvent off to the deliverer for every callback
+// registered for cbpath, either directly or through a matching glob
+// pattern.
+func (b *BoltCallbackStore) Trigger(cbpath string, se *SendableEvent) error {
+	cbs, err := b.matching(cbpath)
+	if err != nil {
+		return err
+	}
+	for _, cb := range cbs {
+		if err := b.deliverer.Enqueue(cb.URL, cb.Secret, se); err != nil {
+			log.Printf("enqueueing delivery of %s to %s: %s", cbpath, cb.URL, err)
+		}
+	}
+	return nil
+}
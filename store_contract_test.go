@@ -0,0 +1,113 @@
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// callbackStorers returns one freshly constructed instance of every
+// CallbackStorer backend, the persistent ones each backed by their own
+// temp file/database, which is released through t.Cleanup. Every backend
+// is run through the same contract below so a regression in one doesn't
+// slip past the others.
+func callbackStorers(t *testing.T) map[string]CallbackStorer {
+	stores := make(map[string]CallbackStorer)
+
+	stores["memory"] = NewMemoryCallbackStore("", NewQueueDeliverer(deliveryWorkers, deliveryQueueSize))
+
+	boltDir, err := ioutil.TempDir("", "fsserver-store-contract")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(boltDir) })
+	boltStore, err := NewBoltCallbackStore(filepath.Join(boltDir, "callbacks.db"), NewQueueDeliverer(deliveryWorkers, deliveryQueueSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { boltStore.Close() })
+	stores["bolt"] = boltStore
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlStore, err := NewSQLCallbackStore(db, NewQueueDeliverer(deliveryWorkers, deliveryQueueSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlStore.Close() })
+	stores["sql"] = sqlStore
+
+	return stores
+}
+
+// TestCallbackStorerContract runs the same sequence of Set/Get/Delete/List
+// calls against every CallbackStorer backend, so each one is held to the
+// same behavior.
+func TestCallbackStorerContract(t *testing.T) {
+	for name, store := range callbackStorers(t) {
+		t.Run(name, func(t *testing.T) {
+			if cbs := store.Get("/foo"); len(cbs) != 0 {
+				t.Errorf("Get() on an unregistered path returned %v, want empty", cbs)
+			}
+
+			store.Set("/foo", "http://one.example")
+			store.Set("/foo", "http://two.example")
+			cbs := store.Get("/foo")
+			if len(cbs) != 2 {
+				t.Fatalf("Get(\"/foo\") returned %v, want 2 entries", cbs)
+			}
+
+			all := store.List()
+			if len(all["/foo"]) != 2 {
+				t.Errorf("List()[\"/foo\"] was %v, want 2 entries", all["/foo"])
+			}
+
+			if err := store.Delete("/foo", "http://one.example"); err != nil {
+				t.Fatalf("Delete() returned an error: %s", err)
+			}
+			cbs = store.Get("/foo")
+			if len(cbs) != 1 || cbs[0] != "http://two.example" {
+				t.Errorf("Get(\"/foo\") after Delete() was %v, want [http://two.example]", cbs)
+			}
+
+			if err := store.SetSecret("http://two.example", "shh"); err != nil {
+				t.Errorf("SetSecret() returned an error: %s", err)
+			}
+		})
+	}
+}
+
+// TestCallbackStorerContractPatternTrigger registers a glob pattern with
+// every backend and confirms Trigger fires it for a path that matches,
+// guarding against a backend only ever doing an exact-path lookup.
+func TestCallbackStorerContractPatternTrigger(t *testing.T) {
+	for name, store := range callbackStorers(t) {
+		t.Run(name, func(t *testing.T) {
+			triggered := make(chan int, 1)
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				triggered <- 1
+			}))
+			defer ts.Close()
+
+			store.Set("logs/**/*.json", ts.URL)
+			if err := store.Trigger("logs/2026/07/30.json", &SendableEvent{Path: "logs/2026/07/30.json", Event: "Create"}); err != nil {
+				t.Fatalf("Trigger() returned an error: %s", err)
+			}
+
+			select {
+			case <-triggered:
+			case <-time.After(time.Second):
+				t.Errorf("pattern registration never fired for a matching path")
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+// sqlSchema creates the callbacks table SQLCallbackStore reads and writes,
+// if it doesn't already exist. pattern distinguishes glob registrations
+// (e.g. "logs/**/*.json") from exact paths, since patterns have to be
+// matched against every triggered path instead of looked up directly,
+// mirroring CallbackStore's storage/patterns split.
+const sqlSchema = `CREATE TABLE IF NOT EXISTS callbacks (
+	path TEXT NOT NULL,
+	url TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	secret TEXT NULL,
+	pattern INTEGER NOT NULL DEFAULT 0
+)`
+
+// SQLCallbackStore is a CallbackStorer backed by database/sql, so
+// registrations survive a restart and can be shared across processes.
+type SQLCallbackStore struct {
+	db           *sql.DB
+	deliverer    Deliverer
+	insertStmt   *sql.Stmt
+	selectStmt   *sql.Stmt
+	patternsStmt *sql.Stmt
+	deleteStmt   *sql.Stmt
+	listStmt     *sql.Stmt
+	secretStmt   *sql.Stmt
+}
+
+// NewSQLCallbackStore creates the callbacks table if necessary and
+// returns a *SQLCallbackStore backed by db that delivers through
+// deliverer.
+func NewSQLCallbackStore(db *sql.DB, deliverer Deliverer) (*SQLCallbackStore, error) {
+	if _, err := db.Exec(sqlSchema); err != nil {
+		return nil, err
+	}
+	insertStmt, err := db.Prepare(`INSERT INTO callbacks (path, url, created_at, secret, pattern) VALUES (?, ?, ?, NULL, ?)`)
+	if err != nil {
+		return nil, err
+	}
+	selectStmt, err := db.Prepare(`SELECT url, secret FROM callbacks WHERE path = ? AND pattern = 0`)
+	if err != nil {
+		return nil, err
+	}
+	patternsStmt, err := db.Prepare(`SELECT path, url, secret FROM callbacks WHERE pattern = 1`)
+	if err != nil {
+		return nil, err
+	}
+	deleteStmt, err := db.Prepare(`DELETE FROM callbacks WHERE path = ? AND url = ?`)
+	if err != nil {
+		return nil, err
+	}
+	listStmt, err := db.Prepare(`SELECT path, url FROM callbacks`)
+	if err != nil {
+		return nil, err
+	}
+	secretStmt, err := db.Prepare(`UPDATE callbacks SET secret = ? WHERE url = ?`)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLCallbackStore{
+		db:           db,
+		deliverer:    deliverer,
+		insertStmt:   insertStmt,
+		selectStmt:   selectStmt,
+		patternsStmt: patternsStmt,
+		deleteStmt:   deleteStmt,
+		listStmt:     listStmt,
+		secretStmt:   secretStmt,
+	}, nil
+}
+
+// Close releases the prepared statements and the underlying *sql.DB.
+func (s *SQLCallbackStore) Close() error {
+	for _, stmt := range []*sql.Stmt{s.insertStmt, s.selectStmt, s.patternsStmt, s.deleteStmt, s.listStmt, s.secretStmt} {
+		stmt.Close()
+	}
+	return s.db.Close()
+}
+
+// Set associates cb with cbpath, persisting the registration. cbpath is
+// stored as a pattern row if it contains glob metacharacters.
+func (s *SQLCallbackStore) Set(cbpath, cb string) {
+	if _, err := s.insertStmt.Exec(cbpath, cb, time.Now(), isPattern(cbpath)); err != nil {
+		log.Printf("SQLCallbackStore.Set(%s, %s): %s", cbpath, cb, err)
+	}
+}
+
+// SetSecret stores the HMAC secret to sign deliveries to cb with, for
+// every row currently registered under that URL.
+func (s *SQLCallbackStore) SetSecret(cb, secret string) error {
+	_, err := s.secretStmt.Exec(secret, cb)
+	return err
+}
+
+// Get returns the callback URLs registered for the exact path cbpath. It
+// does not match cbpath against registered glob patterns; use Trigger for
+// that.
+func (s *SQLCallbackStore) Get(cbpath string) []string {
+	rows, err := s.selectStmt.Query(cbpath)
+	if err != nil {
+		log.Printf("SQLCallbackStore.Get(%s): %s", cbpath, err)
+		return nil
+	}
+	defer rows.Close()
+	var urls []string
+	for rows.Next() {
+		var url string
+		var secret sql.NullString
+		if err := rows.Scan(&url, &secret); err != nil {
+			log.Printf("SQLCallbackStore.Get(%s): %s", cbpath, err)
+			return urls
+		}
+		urls = append(urls, url)
+	}
+	return urls
+}
+
+// Delete removes cb from the callbacks registered for cbpath.
+func (s *SQLCallbackStore) Delete(cbpath, cb string) error {
+	_, err := s.deleteStmt.Exec(cbpath, cb)
+	return err
+}
+
+// List returns every registered path and its callback URLs.
+func (s *SQLCallbackStore) List() map[string][]string {
+	all := make(map[string][]string)
+	rows, err := s.listStmt.Query()
+	if err != nil {
+		log.Printf("SQLCallbackStore.List(): %s", err)
+		return all
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cbpath, url string
+		if err := rows.Scan(&cbpath, &url); err != nil {
+			log.Printf("SQLCallbackStore.List(): %s", err)
+			return all
+		}
+		all[cbpath] = append(all[cbpath], url)
+	}
+	return all
+}
+
+type sqlTarget struct {
+	url    string
+	secret string
+}
+
+// matching returns the callback URLs registered for the exact path
+// cbpath plus every callback registered under a pattern that cbpath
+// matches.
+func (s *SQLCallbackStore) matching(cbpath string) ([]sqlTarget, error) {
+	var targets []sqlTarget
+
+	rows, err := s.selectStmt.Query(cbpath)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var url string
+		var secret sql.NullString
+		if err := rows.Scan(&url, &secret); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		targets = append(targets, sqlTarget{url: url, secret: secret.String})
+	}
+	rows.Close()
+
+	patternRows, err := s.patternsStmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer patternRows.Close()
+	for patternRows.Next() {
+		var pattern, url string
+		var secret sql.NullString
+		if err := patternRows.Scan(&pattern, &url, &secret); err != nil {
+			return nil, err
+		}
+		if matchGlob(pattern, cbpath) {
+			targets = append(targets, sqlTarget{url: url, secret: secret.String})
+		}
+	}
+	return targets, nil
+}
+
+// Trigger hands the SendableEvent off to the deliverer for every callback
+// registered for cbpath, either directly or through a matching glob
+// pattern.
+func (s *SQLCallbackStore) Trigger(cbpath string, se *SendableEvent) error {
+	targets, err := s.matching(cbpath)
+	if err != nil {
+		return err
+	}
+	for _, t := range targets {
+		if err := s.deliverer.Enqueue(t.url, t.secret, se); err != nil {
+			log.Printf("enqueueing delivery of %s to %s: %s", cbpath, t.url, err)
+		}
+	}
+	return nil
+}
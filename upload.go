@@ -0,0 +1,325 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// uploadTTL is how long an upload session can sit idle (no PATCH or PUT)
+// before UploadStore cleans up its temp file.
+const uploadTTL = time.Hour
+
+// uploadSession tracks one in-progress chunked upload. lock serializes
+// access to Offset and file, since chunked upload clients commonly retry
+// or resume with overlapping in-flight PATCH requests against the same
+// upload_id.
+type uploadSession struct {
+	ID        string
+	Path      string //path relative to the watched root this upload will land at
+	tmpPath   string
+	lock      *sync.Mutex
+	file      *os.File
+	Offset    int64
+	StartedAt time.Time
+	ExpiresAt time.Time
+}
+
+// UploadStore tracks in-progress upload sessions, with the same
+// lock-guarded map style as CallbackStore.
+type UploadStore struct {
+	lock     *sync.RWMutex
+	sessions map[string]*uploadSession
+	base     string
+	ttl      time.Duration
+}
+
+// NewUploadStore returns an *UploadStore that stages uploads under base
+// and expires sessions that sit idle longer than ttl.
+func NewUploadStore(base string, ttl time.Duration) *UploadStore {
+	u := &UploadStore{
+		lock:     &sync.RWMutex{},
+		sessions: make(map[string]*uploadSession),
+		base:     base,
+		ttl:      ttl,
+	}
+	go u.sweep()
+	return u
+}
+
+// Create starts a new upload session for relPath and returns it.
+func (u *UploadStore) Create(relPath string) (*uploadSession, error) {
+	id, err := newUploadID()
+	if err != nil {
+		return nil, err
+	}
+	tmpDir := filepath.Join(u.base, ".uploads")
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return nil, err
+	}
+	tmpPath := filepath.Join(tmpDir, id)
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	session := &uploadSession{
+		ID:        id,
+		Path:      relPath,
+		tmpPath:   tmpPath,
+		lock:      &sync.Mutex{},
+		file:      file,
+		StartedAt: now,
+		ExpiresAt: now.Add(u.ttl),
+	}
+	u.lock.Lock()
+	u.sessions[id] = session
+	u.lock.Unlock()
+	return session, nil
+}
+
+// Get returns the session for id, if any.
+func (u *UploadStore) Get(id string) (*uploadSession, bool) {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+	session, ok := u.sessions[id]
+	return session, ok
+}
+
+// Delete cancels an upload session, closing and removing its temp file.
+func (u *UploadStore) Delete(id string) error {
+	u.lock.Lock()
+	session, ok := u.sessions[id]
+	if ok {
+		delete(u.sessions, id)
+	}
+	u.lock.Unlock()
+	if !ok {
+		return fmt.Errorf("no upload session %s", id)
+	}
+	session.file.Close()
+	return os.Remove(session.tmpPath)
+}
+
+// sweep periodically removes sessions that were never finalized or
+// cancelled within their TTL.
+func (u *UploadStore) sweep() {
+	ticker := time.NewTicker(u.ttl)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		u.lock.Lock()
+		for id, session := range u.sessions {
+			if now.After(session.ExpiresAt) {
+				session.file.Close()
+				os.Remove(session.tmpPath)
+				delete(u.sessions, id)
+			}
+		}
+		u.lock.Unlock()
+	}
+}
+
+func newUploadID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// FilesHandler serves the /files/ tree for reads and, modeled on the
+// Docker Registry blob upload protocol, accepts resumable chunked
+// uploads for writes: POST starts a session, PATCH appends a chunk,
+// PUT finalizes it into place, and DELETE cancels it.
+type FilesHandler struct {
+	root       string
+	uploads    *UploadStore
+	fileServer http.Handler
+	broker     *Broker
+}
+
+// NewFilesHandler returns a *FilesHandler serving and accepting uploads
+// into root. broker, if non-nil, is sent a synthetic event whenever an
+// upload is finalized.
+func NewFilesHandler(root string, broker *Broker) *FilesHandler {
+	return &FilesHandler{
+		root:       root,
+		uploads:    NewUploadStore(root, uploadTTL),
+		fileServer: http.FileServer(http.Dir(root)),
+		broker:     broker,
+	}
+}
+
+// ServeHTTP dispatches to the read-only file server or to the upload
+// session handling, based on the request method.
+func (f *FilesHandler) ServeHTTP(resp http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case "GET", "HEAD":
+		f.fileServer.ServeHTTP(resp, request)
+	case "POST":
+		f.startUpload(resp, request)
+	case "PATCH":
+		f.appendUpload(resp, request)
+	case "PUT":
+		f.finalizeUpload(resp, request)
+	case "DELETE":
+		f.cancelUpload(resp, request)
+	default:
+		http.Error(resp, "Not Found!", 404)
+	}
+}
+
+func (f *FilesHandler) startUpload(resp http.ResponseWriter, request *http.Request) {
+	relPath := strings.TrimPrefix(request.URL.Path, "/")
+	session, err := f.uploads.Create(relPath)
+	if err != nil {
+		http.Error(resp, err.Error(), 500)
+		return
+	}
+	resp.Header().Set("Location", uploadLocation(request.URL.Path, session.ID))
+	resp.Header().Set("Range", "0-0")
+	resp.WriteHeader(http.StatusAccepted)
+}
+
+func (f *FilesHandler) appendUpload(resp http.ResponseWriter, request *http.Request) {
+	session, ok := f.uploads.Get(request.URL.Query().Get("upload_id"))
+	if !ok {
+		http.Error(resp, "Not Found!", 404)
+		return
+	}
+	start, _, err := parseContentRange(request.Header.Get("Content-Range"))
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if start != session.Offset {
+		http.Error(resp, fmt.Sprintf("expected Content-Range to start at %d", session.Offset), http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	n, err := io.Copy(session.file, request.Body)
+	if err != nil {
+		http.Error(resp, err.Error(), 500)
+		return
+	}
+	session.Offset += n
+	session.ExpiresAt = time.Now().Add(f.uploads.ttl)
+	resp.Header().Set("Range", fmt.Sprintf("0-%d", session.Offset-1))
+	resp.Header().Set("Location", uploadLocation(request.URL.Path, session.ID))
+	resp.WriteHeader(http.StatusAccepted)
+}
+
+func (f *FilesHandler) finalizeUpload(resp http.ResponseWriter, request *http.Request) {
+	session, ok := f.uploads.Get(request.URL.Query().Get("upload_id"))
+	if !ok {
+		http.Error(resp, "Not Found!", 404)
+		return
+	}
+	session.lock.Lock()
+	if request.Body != nil {
+		if n, err := io.Copy(session.file, request.Body); err == nil {
+			session.Offset += n
+		}
+	}
+	if digest := request.URL.Query().Get("digest"); digest != "" {
+		if err := verifyDigest(session.tmpPath, digest); err != nil {
+			session.lock.Unlock()
+			http.Error(resp, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	session.file.Close()
+	session.lock.Unlock()
+
+	dest := filepath.Join(f.root, session.Path)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		http.Error(resp, err.Error(), 500)
+		return
+	}
+	_, statErr := os.Stat(dest)
+	if err := os.Rename(session.tmpPath, dest); err != nil {
+		http.Error(resp, err.Error(), 500)
+		return
+	}
+	f.uploads.Delete(session.ID)
+
+	if f.broker != nil {
+		event := "Create"
+		if statErr == nil {
+			event = "Modify"
+		}
+		f.broker.Publish(SendableEvent{Path: session.Path, Event: event})
+	}
+	resp.WriteHeader(http.StatusCreated)
+}
+
+func (f *FilesHandler) cancelUpload(resp http.ResponseWriter, request *http.Request) {
+	id := request.URL.Query().Get("upload_id")
+	if err := f.uploads.Delete(id); err != nil {
+		http.Error(resp, err.Error(), 404)
+		return
+	}
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+// uploadLocation builds the URL a client should PATCH/PUT/DELETE to
+// continue the upload session id started at path.
+func uploadLocation(path, id string) string {
+	return fmt.Sprintf("%s?upload_id=%s", path, id)
+}
+
+// parseContentRange parses a "start-end" Content-Range header, as sent by
+// the PATCH step of the upload protocol.
+func parseContentRange(header string) (start, end int64, err error) {
+	if header == "" {
+		return 0, 0, fmt.Errorf("missing Content-Range header")
+	}
+	parts := strings.SplitN(header, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("malformed Content-Range header %q", header)
+	}
+	start, err = strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("malformed Content-Range header %q: %s", header, err)
+	}
+	end, err = strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("malformed Content-Range header %q: %s", header, err)
+	}
+	return start, end, nil
+}
+
+// verifyDigest checks that the sha256 of the file at path matches digest,
+// which must be of the form "sha256:<hex>".
+func verifyDigest(path, digest string) error {
+	const prefix = "sha256:"
+	if !strings.HasPrefix(digest, prefix) {
+		return fmt.Errorf("unsupported digest algorithm in %q", digest)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return err
+	}
+	got := hex.EncodeToString(h.Sum(nil))
+	want := strings.TrimPrefix(digest, prefix)
+	if got != want {
+		return fmt.Errorf("digest mismatch: got sha256:%s, want %s", got, want)
+	}
+	return nil
+}
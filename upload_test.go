@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestFilesHandlerUploadLifecycle(t *testing.T) {
+	root, err := ioutil.TempDir("", "fsserver-upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	handler := NewFilesHandler(root, nil)
+
+	// POST starts the session.
+	postReq, _ := http.NewRequest("POST", "/uploads/foo.txt", nil)
+	postResp := httptest.NewRecorder()
+	handler.ServeHTTP(postResp, postReq)
+	if postResp.Code != http.StatusAccepted {
+		t.Fatalf("POST status was %d", postResp.Code)
+	}
+	location := postResp.Header().Get("Location")
+	if location == "" {
+		t.Fatalf("POST did not return a Location header")
+	}
+
+	// PATCH appends the content.
+	content := []byte("hello world")
+	patchReq, _ := http.NewRequest("PATCH", location, strings.NewReader(string(content)))
+	patchReq.Header.Set("Content-Range", "0-10")
+	patchResp := httptest.NewRecorder()
+	handler.ServeHTTP(patchResp, patchReq)
+	if patchResp.Code != http.StatusAccepted {
+		t.Fatalf("PATCH status was %d", patchResp.Code)
+	}
+
+	// PUT finalizes with a matching digest.
+	sum := sha256.Sum256(content)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	putReq, _ := http.NewRequest("PUT", location+"&digest="+digest, nil)
+	putResp := httptest.NewRecorder()
+	handler.ServeHTTP(putResp, putReq)
+	if putResp.Code != http.StatusCreated {
+		t.Fatalf("PUT status was %d, body: %s", putResp.Code, putResp.Body.String())
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(root, "uploads/foo.txt"))
+	if err != nil {
+		t.Fatalf("finalized file was not written: %s", err)
+	}
+	if string(data) != string(content) {
+		t.Errorf("file contents were %q, want %q", data, content)
+	}
+}
+
+func TestFilesHandlerUploadDigestMismatch(t *testing.T) {
+	root, err := ioutil.TempDir("", "fsserver-upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	handler := NewFilesHandler(root, nil)
+
+	postReq, _ := http.NewRequest("POST", "/bar.txt", nil)
+	postResp := httptest.NewRecorder()
+	handler.ServeHTTP(postResp, postReq)
+	location := postResp.Header().Get("Location")
+
+	patchReq, _ := http.NewRequest("PATCH", location, strings.NewReader("data"))
+	patchReq.Header.Set("Content-Range", "0-3")
+	patchResp := httptest.NewRecorder()
+	handler.ServeHTTP(patchResp, patchReq)
+
+	putReq, _ := http.NewRequest("PUT", location+"&digest=sha256:deadbeef", nil)
+	putResp := httptest.NewRecorder()
+	handler.ServeHTTP(putResp, putReq)
+	if putResp.Code != http.StatusBadRequest {
+		t.Errorf("expected a bad digest to be rejected with 400, got %d", putResp.Code)
+	}
+}
+
+func TestFilesHandlerCancelUpload(t *testing.T) {
+	root, err := ioutil.TempDir("", "fsserver-upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	handler := NewFilesHandler(root, nil)
+
+	postReq, _ := http.NewRequest("POST", "/baz.txt", nil)
+	postResp := httptest.NewRecorder()
+	handler.ServeHTTP(postResp, postReq)
+	location := postResp.Header().Get("Location")
+
+	deleteReq, _ := http.NewRequest("DELETE", location, nil)
+	deleteResp := httptest.NewRecorder()
+	handler.ServeHTTP(deleteResp, deleteReq)
+	if deleteResp.Code != http.StatusNoContent {
+		t.Errorf("DELETE status was %d", deleteResp.Code)
+	}
+
+	if _, ok := handler.uploads.Get(deleteReq.URL.Query().Get("upload_id")); ok {
+		t.Errorf("session should have been removed after cancellation")
+	}
+}
+
+func TestFilesHandlerConcurrentAppend(t *testing.T) {
+	root, err := ioutil.TempDir("", "fsserver-upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	handler := NewFilesHandler(root, nil)
+
+	postReq, _ := http.NewRequest("POST", "/concurrent.txt", nil)
+	postResp := httptest.NewRecorder()
+	handler.ServeHTTP(postResp, postReq)
+	location := postResp.Header().Get("Location")
+
+	// Fire several PATCHes at the same upload_id and the same starting
+	// offset concurrently, the way a retrying/resuming client can. The
+	// session lock should serialize them: exactly one succeeds and
+	// advances the offset, the rest see a stale start and are rejected.
+	const concurrency = 4
+	content := []byte("hello world")
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	accepted, rejected := 0, 0
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			patchReq, _ := http.NewRequest("PATCH", location, strings.NewReader(string(content)))
+			patchReq.Header.Set("Content-Range", "0-10")
+			patchResp := httptest.NewRecorder()
+			handler.ServeHTTP(patchResp, patchReq)
+			lock.Lock()
+			defer lock.Unlock()
+			if patchResp.Code == http.StatusAccepted {
+				accepted++
+			} else {
+				rejected++
+			}
+		}()
+	}
+	wg.Wait()
+
+	if accepted != 1 {
+		t.Errorf("expected exactly 1 PATCH to be accepted, got %d (rejected %d)", accepted, rejected)
+	}
+	if accepted+rejected != concurrency {
+		t.Errorf("expected %d total responses, got %d", concurrency, accepted+rejected)
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	start, end, err := parseContentRange("0-10")
+	if err != nil || start != 0 || end != 10 {
+		t.Errorf("got (%d, %d, %v), want (0, 10, nil)", start, end, err)
+	}
+	if _, _, err := parseContentRange(""); err == nil {
+		t.Errorf("expected an error for an empty header")
+	}
+	if _, _, err := parseContentRange("garbage"); err == nil {
+		t.Errorf("expected an error for a malformed header")
+	}
+}